@@ -1,41 +1,78 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"flag"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
-	"log"
 	"log/syslog"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 var (
-	kannelConf   = flag.String("conf", "/etc/kannel/kannel.conf", "Location of kannel configuration")
-	workersCount = flag.Int("workers", 10, "Workers count")
-	sqlLimit     = flag.Int("limit", 1000, "SQL query limit")
-	pause        = flag.Int("pause", 60, "Pause between queries")
-	conf         *map[string]*Connection
-	db           *sql.DB
-	isBlocked    = false
-	currentPause int
-	mu           sync.Mutex
+	kannelConf      = flag.String("conf", "/etc/kannel/kannel.conf", "Location of kannel configuration")
+	workersCount    = flag.Int("workers", 10, "Workers count")
+	sqlLimit        = flag.Int("limit", 1000, "SQL query limit")
+	pause           = flag.Int("pause", 60, "Pause between queries")
+	noListen        = flag.Bool("no-listen", false, "Disable LISTEN/NOTIFY dispatch and always poll every -pause seconds")
+	sweepInterval   = flag.Int("sweep-interval", 300, "Periodic full sweep interval in seconds while in LISTEN mode, to catch missed rows")
+	httpAddr        = flag.String("http", "", "Address to serve /healthz, /metrics and /events on (e.g. :8080); disabled when empty")
+	requestQPS      = flag.Float64("qps", 20, "Maximum HTTP requests per second, shared across all workers")
+	requestTimeout  = flag.Duration("request-timeout", 10*time.Second, "Per-request timeout for status and callback HTTP calls")
+	requestRetries  = flag.Int("request-retries", 3, "Retries for 5xx/network errors on status and callback HTTP calls")
+	logFormat       = flag.String("log-format", "text", "Log output format: text or json")
+	logLevel        = flag.String("log-level", "info", "Log level: debug, info, warn, error")
+	conf            *map[string]*Connection
+	db              *sql.DB
+	isBlocked       = false
+	blockRetryAfter time.Duration
+	currentPause    atomic.Int32
+	mu              sync.Mutex
+
+	// sweepMu serializes sweepOnce: the periodic sweep ticker and the
+	// LISTEN/NOTIFY debounce timer run on different goroutines and could
+	// otherwise both fire at once, double-querying and double-callbacking
+	// the same rows.
+	sweepMu sync.Mutex
 )
 
 const (
 	sqlRecords = "select id, ts, smsc, url, destination from dlr where status='0' order by id desc limit $1"
 	sqlUpdate  = "update dlr set status=$1 where id=$2"
 	statusUrl  = "http://smsc.ru/sys/status.php?login=%s&psw=%s&phone=%s&id=%d&fmt=3"
+
+	// listenChannel is the NOTIFY channel a trigger on the dlr table should
+	// publish to, e.g.:
+	//   CREATE TRIGGER dlr_inserted AFTER INSERT ON dlr
+	//     FOR EACH ROW EXECUTE PROCEDURE notify_dlr_inserted();
+	// where notify_dlr_inserted() calls pg_notify('dlr_inserted', NEW.id::text).
+	listenChannel = "dlr_inserted"
+
+	// notifyDebounce coalesces bursts of notifications into a single sweep.
+	notifyDebounce = time.Second
+
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+
+	// logBufferLines is how many recent log lines /events replays to a
+	// newly connected SSE client before streaming live lines.
+	logBufferLines = 500
+
+	// shutdownGracePeriod bounds how long processRecords waits, once ctx is
+	// cancelled, for workers to finish in-flight HTTP calls.
+	shutdownGracePeriod = 30 * time.Second
 )
 
 type Msg struct {
@@ -52,6 +89,33 @@ type Connection struct {
 	host     string
 	port     string
 	database string //for pg configuration
+
+	// statusProvider selects which StatusProvider implementation is used
+	// to check delivery status for messages routed through this smsc-id.
+	// Defaults to "smscru" when unset, matching the historical behavior.
+	statusProvider string
+
+	// status-provider "http-json" configuration: a URL template taking the
+	// same %s/%d verbs as statusUrl, plus the JSON field names to read the
+	// status/err/error-code from, and the numeric ranges that count as a
+	// successful delivery or a temporary block.
+	statusURL         string
+	statusFieldStatus string
+	statusFieldErr    string
+	statusFieldCode   string
+	successCodeMin    int
+	successCodeMax    int
+	blockedCodeMin    int
+	blockedCodeMax    int
+
+	// status-provider "smpp-query" configuration: host/port/login/psw
+	// above are reused as the SMPP bind address and credentials for the
+	// short-lived query_sm session. systemType is the optional SMPP
+	// system_type to bind with (system-type); querySourceAddr is the
+	// source_addr query_sm must report the original submit_sm came from,
+	// since the dlr table carries no such column (query-source-addr).
+	systemType      string
+	querySourceAddr string
 }
 
 type HttpResult struct {
@@ -61,6 +125,24 @@ type HttpResult struct {
 	ErrorCode int    `json:"error_code"`
 }
 
+// parseRange parses a "min-max" config value such as "0-3" into its two
+// bounds, returning zeros if the value is malformed.
+func parseRange(val string) (int, int) {
+	parts := strings.SplitN(val, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0
+	}
+	return min, max
+}
+
 func loadConfiguration() *map[string]*Connection {
 	conf := make(map[string]*Connection)
 	bin, err := ioutil.ReadFile(*kannelConf)
@@ -116,6 +198,33 @@ func loadConfiguration() *map[string]*Connection {
 				if key == "database" {
 					conf[currentGroup].database = val
 				}
+				if key == "status-provider" {
+					conf[currentGroup].statusProvider = val
+				}
+				if key == "status-url" {
+					conf[currentGroup].statusURL = val
+				}
+				if key == "status-field-status" {
+					conf[currentGroup].statusFieldStatus = val
+				}
+				if key == "status-field-err" {
+					conf[currentGroup].statusFieldErr = val
+				}
+				if key == "status-field-error-code" {
+					conf[currentGroup].statusFieldCode = val
+				}
+				if key == "status-success-range" {
+					conf[currentGroup].successCodeMin, conf[currentGroup].successCodeMax = parseRange(val)
+				}
+				if key == "status-blocked-range" {
+					conf[currentGroup].blockedCodeMin, conf[currentGroup].blockedCodeMax = parseRange(val)
+				}
+				if key == "system-type" {
+					conf[currentGroup].systemType = val
+				}
+				if key == "query-source-addr" {
+					conf[currentGroup].querySourceAddr = val
+				}
 			}
 		}
 
@@ -123,66 +232,104 @@ func loadConfiguration() *map[string]*Connection {
 	return &conf
 }
 
-func processMessage(msg *Msg) {
-	if conn, exists := (*conf)[msg.smsc]; exists == true {
-		login := url.QueryEscape(conn.login)
-		psw := url.QueryEscape(conn.psw)
-		phone := url.QueryEscape(msg.phone)
+// logMessageResult emits one structured log line per processed message,
+// carrying the fields an operator needs to query for a specific failing
+// smsc or MSISDN in a log aggregator: msg_id, external_id, smsc,
+// phone_hash, status, error_code and duration_ms, plus the sweep's run_id
+// via entry. outcome distinguishes a terminal failure (err set), the smsc
+// asking us to back off (blocked), a message not yet ready to report
+// (pending) and a successful callback (processed).
+func logMessageResult(entry *log.Entry, start time.Time, status, errCode int, outcome string, err error) {
+	fields := entry.WithFields(log.Fields{
+		"status":      status,
+		"error_code":  errCode,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+	if err != nil {
+		fields.WithError(err).Error("message processing failed")
+		return
+	}
+	fields.Info("message " + outcome)
+}
 
-		url := fmt.Sprintf(statusUrl, login, psw, phone, msg.externalId)
-		resp, err := http.Get(url)
-		if err != nil {
-			log.Printf("Msg %d processing error: %v", msg.externalId, err)
-			return
-		}
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Msg %d body read error: %v", msg.externalId, err)
-			return
-		}
-		var httpResult HttpResult
-		json.Unmarshal(body, &httpResult)
-
-		if httpResult.ErrorCode > 0 {
-			if httpResult.ErrorCode >= 4 {
-				//temporary block
-				mu.Lock()
-				isBlocked = true
-				mu.Unlock()
-			} else {
-				callbackUrl := fmt.Sprintf(msg.url, 2)
-				http.Get(callbackUrl)
-				db.Exec(sqlUpdate, "2", msg.id)
-			}
-		} else {
-			if httpResult.Status > 0 {
-				callbackUrl := fmt.Sprintf(msg.url, httpResult.Status)
-				client := &http.Client{}
-				req, _ := http.NewRequest("GET", callbackUrl, nil)
-				req.Header.Add("SMSC-ERROR", strconv.Itoa(httpResult.Err))
-				resp, err := client.Do(req)
-				if err != nil {
-					log.Printf("Msg %d callback error: %v", msg.externalId, err)
-					return
-				}
-				body, err = ioutil.ReadAll(resp.Body)
-				if err != nil {
-					return
-				}
-				db.Exec(sqlUpdate, strconv.Itoa(httpResult.Status), msg.id)
-			}
-		}
+func processMessage(ctx context.Context, msg *Msg) {
+	start := time.Now()
+	metricsProcessed.Inc()
+
+	entry := runEntry(ctx).WithFields(log.Fields{
+		"msg_id":      msg.id,
+		"external_id": msg.externalId,
+		"smsc":        msg.smsc,
+		"phone_hash":  phoneHash(msg.phone),
+	})
+
+	conn, exists := (*conf)[msg.smsc]
+	if !exists {
+		logMessageResult(entry, start, 0, 0, "", fmt.Errorf("no configuration for smsc %q", msg.smsc))
+		return
+	}
+
+	provider := providerFor(conn)
+	status, errCode, tempBlock, err := provider.Query(ctx, msg, conn)
+	if err != nil {
+		metricsErrors.Inc()
+		logMessageResult(entry, start, status, errCode, "", err)
+		return
+	}
+
+	if tempBlock {
+		metricsTempBlock.Inc()
+		setBlocked(0)
+		logMessageResult(entry, start, status, errCode, "blocked", nil)
+		return
+	}
+	if status <= 0 {
+		logMessageResult(entry, start, status, errCode, "pending", nil)
+		return
 	}
+
+	// Mark the row processed as soon as the smsc has given us a final
+	// status, independent of whether the kannel callback below succeeds:
+	// a kannel endpoint that's down or unreachable must not make us
+	// re-query the smsc and retry this callback forever on every sweep.
+	db.Exec(sqlUpdate, strconv.Itoa(status), msg.id)
+
+	callbackUrl := fmt.Sprintf(msg.url, status)
+	req, _ := http.NewRequestWithContext(ctx, "GET", callbackUrl, nil)
+	req.Header.Add("SMSC-ERROR", strconv.Itoa(errCode))
+	resp, err := doRequest(req)
+	if err == errBlocked {
+		metricsTempBlock.Inc()
+		logMessageResult(entry, start, status, errCode, "blocked", nil)
+		return
+	}
+	if err != nil {
+		metricsErrors.Inc()
+		logMessageResult(entry, start, status, errCode, "", err)
+		return
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		logMessageResult(entry, start, status, errCode, "", err)
+		return
+	}
+	metricsSuccess.Inc()
+	logMessageResult(entry, start, status, errCode, "processed", nil)
 }
 
-func checkMessages(chm chan *Msg, wg *sync.WaitGroup) {
+func checkMessages(ctx context.Context, chm chan *Msg, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for msg := range chm {
-		processMessage(msg)
+		processMessage(ctx, msg)
 	}
 }
 
-func processRecords() int {
+// processRecords queries pending rows and fans them out to *workersCount
+// workers. While ctx is live it keeps feeding rows to the channel as fast
+// as they're scanned; once ctx is cancelled it stops feeding new rows,
+// closes the channel, and gives in-flight workers up to
+// shutdownGracePeriod to finish before returning.
+func processRecords(ctx context.Context) int {
 	var wg sync.WaitGroup
 	var count = 0
 	chm := make(chan *Msg, *workersCount)
@@ -195,39 +342,205 @@ func processRecords() int {
 
 	for i := 0; i < *workersCount; i += 1 {
 		wg.Add(1)
-		go checkMessages(chm, &wg)
+		go checkMessages(ctx, chm, &wg)
 	}
+
+feed:
 	for rows.Next() {
-		msg := Msg{}
+		select {
+		case <-ctx.Done():
+			break feed
+		default:
+		}
+		msg := &Msg{}
 		rows.Scan(&msg.id, &msg.externalId, &msg.smsc, &msg.url, &msg.phone)
-		chm <- &msg
+		chm <- msg
 		count += 1
 	}
 	if err := rows.Err(); err != nil {
 		log.Fatal(err)
 	}
 	close(chm)
-	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		select {
+		case <-done:
+		case <-time.After(shutdownGracePeriod):
+			runEntry(ctx).Warn("Shutdown grace period elapsed with workers still in flight")
+		}
+	}
 
 	return count
 }
 
-func main() {
-	logwriter, e := syslog.New(syslog.LOG_NOTICE, "smsc_ru_checker")
-	if e == nil {
-		log.SetOutput(logwriter)
+// sweepOnce runs processRecords once and applies the temporary-block backoff
+// to currentPause, returning the number of records processed. It is a no-op
+// if another sweep is already in flight, since the periodic sweep ticker and
+// the LISTEN/NOTIFY debounce timer can otherwise both call it concurrently.
+func sweepOnce(ctx context.Context) int {
+	if !sweepMu.TryLock() {
+		runEntry(ctx).Debug("Sweep already in progress, skipping")
+		return 0
+	}
+	defer sweepMu.Unlock()
+
+	ctx = withRunID(ctx, newRunID())
+	entry := runEntry(ctx)
+
+	count := processRecords(ctx)
+	entry.WithField("count", count).Info("Processed records")
+	if isBlocked {
+		mu.Lock()
+		retryAfter := blockRetryAfter
+		blockRetryAfter = 0
+		isBlocked = false
+		mu.Unlock()
+
+		var pauseSecs int
+		if retryAfter > 0 {
+			pauseSecs = int(retryAfter.Seconds())
+		} else {
+			pauseSecs = 60 * 10 // 10 minutes
+		}
+		currentPause.Store(int32(pauseSecs))
+		metricsBlocked.Set(1)
+		entry.WithField("retry_after_seconds", pauseSecs).Warn("Program is blocked temporarily")
+	} else {
+		currentPause.Store(int32(*pause))
+		metricsBlocked.Set(0)
+	}
+	return count
+}
+
+// setBlocked marks the checker as temporarily blocked by an smsc. If
+// retryAfter is non-zero (from a Retry-After header) it takes precedence
+// over the default 10 minute backoff the next sweep applies.
+func setBlocked(retryAfter time.Duration) {
+	mu.Lock()
+	isBlocked = true
+	if retryAfter > blockRetryAfter {
+		blockRetryAfter = retryAfter
+	}
+	mu.Unlock()
+}
+
+// pollLoop is the original fixed-interval behavior, kept for installations
+// that cannot add the dlr_inserted trigger. It returns once ctx is done.
+func pollLoop(ctx context.Context) {
+	for {
+		sweepOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * time.Duration(currentPause.Load())):
+		}
 	}
+}
 
+// listenLoop drives processRecords from PostgreSQL LISTEN/NOTIFY
+// notifications on listenChannel, with a long periodic sweep as a safety
+// net for missed rows and to honor the block backoff. It returns once ctx
+// is done.
+func listenLoop(ctx context.Context, conn string) {
+	reportProblem := func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Listener event %d: %v", ev, err)
+		}
+	}
+	listener := pq.NewListener(conn, listenerMinReconnect, listenerMaxReconnect, reportProblem)
+	defer listener.Close()
+	if err := listener.Listen(listenChannel); err != nil {
+		log.Fatal(err)
+	}
+
+	sweep := time.NewTicker(time.Duration(*sweepInterval) * time.Second)
+	defer sweep.Stop()
+
+	sweepOnce(ctx)
+
+	var debounce *time.Timer
+	defer func() {
+		// Stop the debounce timer and wait out any sweep it already started,
+		// so no sweep is still running when main closes db.
+		if debounce != nil {
+			debounce.Stop()
+		}
+		sweepMu.Lock()
+		sweepMu.Unlock()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n, ok := <-listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// Connection was lost and has been re-established by the
+				// listener; sweep now in case we missed notifications.
+				log.Printf("Listener reconnected, running a catch-up sweep")
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(notifyDebounce, func() { sweepOnce(ctx) })
+				continue
+			}
+			if debounce == nil {
+				debounce = time.AfterFunc(notifyDebounce, func() { sweepOnce(ctx) })
+			} else {
+				debounce.Reset(notifyDebounce)
+			}
+		case <-sweep.C:
+			sweepOnce(ctx)
+		case <-time.After(listenerMaxReconnect):
+			// Ping keeps the underlying connection alive and detects a
+			// half-open socket faster than waiting for the next notify.
+			go listener.Ping()
+		}
+		if currentPause.Load() > int32(*pause) {
+			// We got blocked; pause the sweep ticker's effect by sleeping
+			// out the backoff before accepting further notifications.
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second * time.Duration(currentPause.Load())):
+			}
+			currentPause.Store(int32(*pause))
+		}
+	}
+}
+
+func main() {
 	flag.Parse()
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	var logOutput io.Writer = os.Stderr
+	if logwriter, e := syslog.New(syslog.LOG_NOTICE, "smsc_ru_checker"); e == nil {
+		logOutput = logwriter
+	}
+
+	logBuf := NewBufferBroadcast(logBufferLines)
+	log.SetOutput(&logFanout{underlying: logOutput, buf: logBuf})
+
 	conf = loadConfiguration()
+	initHTTPClient()
 
-	go func() {
-		sigchan := make(chan os.Signal, 10)
-		signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
-		<-sigchan
-		log.Println("Got interrupt signal. Exited")
-		os.Exit(0)
-	}()
+	if *httpAddr != "" {
+		startHTTPServer(*httpAddr, logBuf)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
 	defer func() {
 		if err := recover(); err != nil {
@@ -241,21 +554,16 @@ func main() {
 
 	var err error
 	db, err = sql.Open("postgres", conn)
-	defer db.Close()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for {
-		count := processRecords()
-		log.Printf("Processed %d records", count)
-		if isBlocked {
-			currentPause = 60 * 10 // 10 minutes
-			isBlocked = false
-			log.Printf("Program is blocked temporarily. Next processing will start after %d seconds", currentPause)
-		} else {
-			currentPause = *pause
-		}
-		time.Sleep(time.Second * time.Duration(currentPause))
+	if *noListen {
+		pollLoop(ctx)
+	} else {
+		listenLoop(ctx, conn)
 	}
+
+	log.Println("Got shutdown signal, drained in-flight work, closing database connection")
+	db.Close()
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	metricsProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smpp_checker_processed_total",
+		Help: "Total number of dlr rows processed.",
+	})
+	metricsSuccess = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smpp_checker_success_total",
+		Help: "Total number of dlr rows successfully delivered to the callback URL.",
+	})
+	metricsTempBlock = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smpp_checker_tempblock_total",
+		Help: "Total number of times an smsc reported a temporary block.",
+	})
+	metricsErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smpp_checker_errors_total",
+		Help: "Total number of processing errors (status-provider or callback failures).",
+	})
+	metricsBlocked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smpp_checker_blocked",
+		Help: "1 while the checker is backing off after a temporary block, 0 otherwise.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricsProcessed, metricsSuccess, metricsTempBlock, metricsErrors, metricsBlocked)
+}
+
+// BufferBroadcast fans a stream of lines out to any number of listeners,
+// replaying a ring buffer of recent lines to each new listener. It backs
+// the /events SSE endpoint.
+type BufferBroadcast struct {
+	mu        sync.Mutex
+	size      int
+	ring      []string
+	listeners map[chan string]bool
+}
+
+func NewBufferBroadcast(size int) *BufferBroadcast {
+	return &BufferBroadcast{
+		size:      size,
+		listeners: make(map[chan string]bool),
+	}
+}
+
+// BroadcastString appends line to the ring buffer and pushes it to every
+// listener, dropping (and closing) any listener whose buffer is full
+// instead of blocking on it. This runs on every log line, including the
+// hot path from every worker, so it must never block: a slow /events
+// client must not be able to back-pressure the processing pipeline.
+func (b *BufferBroadcast) BroadcastString(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ring = append(b.ring, line)
+	if len(b.ring) > b.size {
+		b.ring = b.ring[len(b.ring)-b.size:]
+	}
+	for ch := range b.listeners {
+		select {
+		case ch <- line:
+		default:
+			delete(b.listeners, ch)
+			close(ch)
+		}
+	}
+}
+
+// Listen registers a new listener, returning its channel plus a snapshot
+// of the current ring buffer to replay before live lines.
+func (b *BufferBroadcast) Listen() (chan string, []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan string, 64)
+	b.listeners[ch] = true
+	backlog := make([]string, len(b.ring))
+	copy(backlog, b.ring)
+	return ch, backlog
+}
+
+// Remove unregisters and closes a listener channel previously returned by
+// Listen. Safe to call more than once for the same channel.
+func (b *BufferBroadcast) Remove(ch chan string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.listeners[ch] {
+		delete(b.listeners, ch)
+		close(ch)
+	}
+}
+
+// logFanout is an io.Writer that mirrors everything written to it into a
+// BufferBroadcast (one line at a time) while still passing it through to
+// the real log destination (syslog or stderr).
+type logFanout struct {
+	underlying io.Writer
+	buf        *BufferBroadcast
+}
+
+func (f *logFanout) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			f.buf.BroadcastString(line)
+		}
+	}
+	if f.underlying != nil {
+		return f.underlying.Write(p)
+	}
+	return len(p), nil
+}
+
+// startHTTPServer starts the optional -http server exposing /healthz,
+// /metrics and /events. It runs in the background; a failure to bind is
+// logged rather than fatal, since the checker itself doesn't depend on it.
+func startHTTPServer(addr string, logBuf *BufferBroadcast) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := db.Ping(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/events", serveEvents(logBuf))
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("http server on %s stopped: %v", addr, err)
+		}
+	}()
+	log.Printf("Serving /healthz, /metrics and /events on %s", addr)
+}
+
+// serveEvents streams recent and then live log lines from logBuf as
+// Server-Sent Events.
+func serveEvents(logBuf *BufferBroadcast) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		ch, backlog := logBuf.Listen()
+		defer logBuf.Remove(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		for _, line := range backlog {
+			fmt.Fprintf(w, "data: %s\n\n", line)
+		}
+		flusher.Flush()
+
+		for {
+			select {
+			case line, ok := <-ch:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(w, "data: %s\n\n", line)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
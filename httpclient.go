@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// errBlocked is returned by doRequest when the smsc answers with HTTP 429,
+// after it has already called setBlocked with any Retry-After it sent.
+var errBlocked = errors.New("smsc responded 429 Too Many Requests")
+
+var (
+	sharedHTTPClient *http.Client
+	limiter          *rate.Limiter
+)
+
+func init() {
+	sharedHTTPClient = &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 20,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// initHTTPClient applies the -qps and -request-timeout flags once they've
+// been parsed. Called from main before any worker starts making requests.
+func initHTTPClient() {
+	sharedHTTPClient.Timeout = *requestTimeout
+	limiter = rate.NewLimiter(rate.Limit(*requestQPS), int(*requestQPS)+1)
+}
+
+// doRequest runs req through the shared rate limiter and shared client,
+// retrying 5xx responses and network errors with exponential backoff and
+// jitter, up to -request-retries times. A 429 response calls setBlocked
+// with any Retry-After header and returns errBlocked without retrying.
+func doRequest(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	var lastErr error
+
+	for attempt := 0; attempt <= *requestRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff(attempt)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := sharedHTTPClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			setBlocked(retryAfterDuration(resp.Header.Get("Retry-After")))
+			resp.Body.Close()
+			return nil, errBlocked
+		}
+		if resp.StatusCode >= 500 {
+			lastErr = &httpStatusError{resp.StatusCode}
+			resp.Body.Close()
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+type httpStatusError struct {
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return "smsc returned " + strconv.Itoa(e.code)
+}
+
+// backoff returns an exponentially growing delay with jitter for the given
+// (1-indexed) retry attempt, starting around 200ms and doubling each time.
+func backoff(attempt int) time.Duration {
+	base := 200 * time.Millisecond * time.Duration(uint(1)<<uint(attempt-1))
+	return base + time.Duration(rand.Int63n(int64(base)))
+}
+
+// retryAfterDuration parses a Retry-After header, which may be a number of
+// seconds or an HTTP-date. Returns 0 if absent or unparseable, letting the
+// caller fall back to the default backoff.
+func retryAfterDuration(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
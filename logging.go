@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type ctxKey int
+
+// runIDKey is the context key sweepOnce uses to attach a sweep's
+// run_id so every log line emitted while processing it can be correlated.
+const runIDKey ctxKey = iota
+
+// newRunID returns a short random hex identifier for correlating every log
+// line emitted by a single processRecords sweep.
+func newRunID() string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// withRunID attaches a sweep's run_id to ctx so runEntry can pick it up for
+// every log line emitted while processing that sweep.
+func withRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey, runID)
+}
+
+// runEntry returns a logrus.Entry carrying the run_id of the
+// processRecords sweep ctx belongs to, if any.
+func runEntry(ctx context.Context) *log.Entry {
+	if runID, ok := ctx.Value(runIDKey).(string); ok {
+		return log.WithField("run_id", runID)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// phoneHash returns a short, non-reversible fingerprint of an MSISDN,
+// suitable for correlating log lines for a given phone without writing the
+// raw number to logs or log aggregators.
+func phoneHash(phone string) string {
+	sum := sha256.Sum256([]byte(phone))
+	return hex.EncodeToString(sum[:6])
+}
+
+// setupLogging configures the package-wide logrus logger's formatter and
+// level from the -log-format and -log-level flag values. It must run after
+// flag.Parse; the chosen io.Writer (stderr or syslog) is installed
+// separately via log.SetOutput so syslog remains an option under either
+// format.
+func setupLogging(format, level string) error {
+	switch format {
+	case "text", "":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown -log-format %q, want text or json", format)
+	}
+
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("unknown -log-level %q: %v", level, err)
+	}
+	log.SetLevel(lvl)
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/fiorix/go-smpp/smpp"
+)
+
+// StatusProvider queries delivery status for a single message from a smsc.
+// status/errCode follow the same convention the dlr callback URL expects:
+// status is the delivery code to report back to kannel, errCode is passed
+// through in the SMSC-ERROR header. tempBlock signals that the smsc is
+// rate-limiting or otherwise temporarily unavailable and processing should
+// back off. ctx is cancelled on shutdown and should abort any in-flight
+// network call.
+type StatusProvider interface {
+	Query(ctx context.Context, msg *Msg, conn *Connection) (status int, errCode int, tempBlock bool, err error)
+}
+
+// providerFor picks the StatusProvider for a smsc-id based on its
+// status-provider configuration key, defaulting to the original smsc.ru
+// behavior for installations that don't set one.
+func providerFor(conn *Connection) StatusProvider {
+	switch conn.statusProvider {
+	case "http-json":
+		return httpJSONProvider{}
+	case "smpp-query":
+		return smppQueryProvider{}
+	default:
+		return smscRuProvider{}
+	}
+}
+
+// smscRuProvider is the original, hardcoded smsc.ru status.php behavior.
+type smscRuProvider struct{}
+
+func (smscRuProvider) Query(ctx context.Context, msg *Msg, conn *Connection) (int, int, bool, error) {
+	login := url.QueryEscape(conn.login)
+	psw := url.QueryEscape(conn.psw)
+	phone := url.QueryEscape(msg.phone)
+
+	reqUrl := fmt.Sprintf(statusUrl, login, psw, phone, msg.externalId)
+	req, _ := http.NewRequestWithContext(ctx, "GET", reqUrl, nil)
+	resp, err := doRequest(req)
+	if err != nil {
+		if err == errBlocked {
+			return 0, 0, true, nil
+		}
+		return 0, 0, false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	var httpResult HttpResult
+	json.Unmarshal(body, &httpResult)
+
+	if httpResult.ErrorCode > 0 {
+		if httpResult.ErrorCode >= 4 {
+			return 0, 0, true, nil
+		}
+		return 2, httpResult.Err, false, nil
+	}
+	return httpResult.Status, httpResult.Err, false, nil
+}
+
+// httpJSONProvider is a generic HTTP/JSON status provider for SMSCs that
+// speak a similar protocol to smsc.ru but with a different URL shape and
+// JSON field names. It is configured per smsc-id via the status-url,
+// status-field-status, status-field-err, status-field-error-code,
+// status-success-range and status-blocked-range kannel.conf keys.
+type httpJSONProvider struct{}
+
+func (httpJSONProvider) Query(ctx context.Context, msg *Msg, conn *Connection) (int, int, bool, error) {
+	login := url.QueryEscape(conn.login)
+	psw := url.QueryEscape(conn.psw)
+	phone := url.QueryEscape(msg.phone)
+
+	reqUrl := fmt.Sprintf(conn.statusURL, login, psw, phone, msg.externalId)
+	req, _ := http.NewRequestWithContext(ctx, "GET", reqUrl, nil)
+	resp, err := doRequest(req)
+	if err != nil {
+		if err == errBlocked {
+			return 0, 0, true, nil
+		}
+		return 0, 0, false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return 0, 0, false, err
+	}
+
+	code := jsonInt(fields, conn.statusFieldCode)
+	if conn.blockedCodeMax > 0 && code >= conn.blockedCodeMin && code <= conn.blockedCodeMax {
+		return 0, 0, true, nil
+	}
+
+	status := jsonInt(fields, conn.statusFieldStatus)
+	errCode := jsonInt(fields, conn.statusFieldErr)
+	if conn.successCodeMax > 0 && (status < conn.successCodeMin || status > conn.successCodeMax) {
+		return 0, errCode, false, nil
+	}
+	return status, errCode, false, nil
+}
+
+// jsonInt reads an int out of a decoded JSON object, tolerating both
+// numeric and string-encoded fields. Returns 0 if name is empty or absent.
+func jsonInt(fields map[string]interface{}, name string) int {
+	if name == "" {
+		return 0
+	}
+	switch v := fields[name].(type) {
+	case float64:
+		return int(v)
+	case string:
+		n, _ := strconv.Atoi(v)
+		return n
+	default:
+		return 0
+	}
+}
+
+// smppQueryProvider checks delivery status by opening a short-lived SMPP
+// bind to the smsc and issuing a query_sm for the message's external id,
+// for SMSCs that don't expose an HTTP status API at all. conn.host/port/
+// login/psw are reused as the SMPP bind address and credentials, and
+// conn.systemType (system-type) is the optional system_type to bind with.
+type smppQueryProvider struct{}
+
+func (smppQueryProvider) Query(ctx context.Context, msg *Msg, conn *Connection) (int, int, bool, error) {
+	if conn.querySourceAddr == "" {
+		return 0, 0, false, fmt.Errorf("smsc-id %q: smpp-query status provider requires query-source-addr "+
+			"to be configured (the dlr table carries no originating source_addr to query_sm with)", msg.smsc)
+	}
+
+	tx := &smpp.Transceiver{
+		Addr:       conn.host + ":" + conn.port,
+		User:       conn.login,
+		Passwd:     conn.psw,
+		SystemType: conn.systemType,
+	}
+	defer tx.Close()
+
+	connStatus := tx.Bind()
+	select {
+	case s := <-connStatus:
+		if s.Status() != smpp.Connected {
+			return 0, 0, false, fmt.Errorf("smpp bind to %s failed: %v", tx.Addr, s.Error())
+		}
+	case <-time.After(10 * time.Second):
+		return 0, 0, false, fmt.Errorf("smpp bind to %s timed out", tx.Addr)
+	case <-ctx.Done():
+		return 0, 0, false, ctx.Err()
+	}
+
+	resp, err := tx.QuerySM(conn.querySourceAddr, strconv.Itoa(msg.externalId), 0, 0)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return mapSMPPMessageState(resp.MsgState)
+}
+
+// smppStateCodes assigns each SMPP v3.4 message_state (spec section 5.2.28)
+// its numeric value, for reporting as errCode in the SMSC-ERROR header.
+var smppStateCodes = map[string]int{
+	"SCHEDULED":     0,
+	"ENROUTE":       1,
+	"DELIVERED":     2,
+	"EXPIRED":       3,
+	"DELETED":       4,
+	"UNDELIVERABLE": 5,
+	"ACCEPTED":      6,
+	"UNKNOWN":       7,
+	"REJECTED":      8,
+	"SKIPPED":       9,
+}
+
+// mapSMPPMessageState translates the MsgState string returned by QuerySM
+// (see SMPP v3.4 spec, section 5.2.28) into the status/errCode/tempBlock
+// convention the rest of the checker uses.
+func mapSMPPMessageState(state string) (int, int, bool, error) {
+	switch state {
+	case "DELIVERED":
+		return 1, 0, false, nil
+	case "EXPIRED", "DELETED", "UNDELIVERABLE", "REJECTED":
+		return 2, smppStateCodes[state], false, nil
+	case "ENROUTE", "ACCEPTED", "UNKNOWN":
+		return 0, 0, false, nil
+	default:
+		return 0, 0, true, nil
+	}
+}